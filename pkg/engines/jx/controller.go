@@ -15,7 +15,9 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -37,15 +39,17 @@ const (
 
 // LighthouseJobReconciler reconciles a LighthouseJob object
 type LighthouseJobReconciler struct {
-	client    client.Client
-	logger    *logrus.Entry
-	scheme    *runtime.Scheme
-	namespace string
-	mpClient  metapipeline.Client
+	client            client.Client
+	logger            *logrus.Entry
+	scheme            *runtime.Scheme
+	namespace         string
+	mpClient          metapipeline.Client
+	customTaskClient  CustomTaskClient
+	branchSHAResolver BranchSHAResolver
 }
 
 // NewLighthouseJobReconciler creates a LighthouseJob reconciler
-func NewLighthouseJobReconciler(client client.Client, scheme *runtime.Scheme, namespace string, mpClient metapipeline.Client) (*LighthouseJobReconciler, error) {
+func NewLighthouseJobReconciler(client client.Client, scheme *runtime.Scheme, namespace string, mpClient metapipeline.Client, customTaskClient CustomTaskClient, branchSHAResolver BranchSHAResolver) (*LighthouseJobReconciler, error) {
 	if mpClient == nil {
 		_mpClient, _, _, err := NewMetaPipelineClient(namespace)
 		if err != nil {
@@ -53,12 +57,28 @@ func NewLighthouseJobReconciler(client client.Client, scheme *runtime.Scheme, na
 		}
 		mpClient = _mpClient
 	}
+	if customTaskClient == nil {
+		_customTaskClient, err := NewCustomTaskClient(namespace)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create custom task client")
+		}
+		customTaskClient = _customTaskClient
+	}
+	if branchSHAResolver == nil {
+		_branchSHAResolver, err := NewBranchSHAResolver(namespace)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create branch SHA resolver")
+		}
+		branchSHAResolver = _branchSHAResolver
+	}
 	return &LighthouseJobReconciler{
-		client:    client,
-		logger:    logrus.NewEntry(logrus.StandardLogger()).WithField("controller", controllerName),
-		scheme:    scheme,
-		namespace: namespace,
-		mpClient:  mpClient,
+		client:            client,
+		logger:            logrus.NewEntry(logrus.StandardLogger()).WithField("controller", controllerName),
+		scheme:            scheme,
+		namespace:         namespace,
+		mpClient:          mpClient,
+		customTaskClient:  customTaskClient,
+		branchSHAResolver: branchSHAResolver,
 	}, nil
 }
 
@@ -79,6 +99,25 @@ func (r *LighthouseJobReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	}); err != nil {
 		return err
 	}
+	if err := mgr.GetFieldIndexer().IndexField(&lighthousev1alpha1.LighthouseJob{}, rerunParentJobNameKey, func(rawObj runtime.Object) []string {
+		obj := rawObj.(*lighthousev1alpha1.LighthouseJob)
+		parent := parentJobName(obj)
+		if parent == "" {
+			return nil
+		}
+		return []string{parent}
+	}); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(&lighthousev1alpha1.LighthouseJob{}, stageRootJobNameKey, func(rawObj runtime.Object) []string {
+		obj := rawObj.(*lighthousev1alpha1.LighthouseJob)
+		if _, isStageGraph := obj.Annotations[stagesAnnotation]; !isStageGraph {
+			return nil
+		}
+		return []string{stageRootJobName(obj)}
+	}); err != nil {
+		return err
+	}
 	c, err := controller.New(controllerName, mgr, controller.Options{
 		Reconciler: r,
 	})
@@ -115,6 +154,54 @@ func (r *LighthouseJobReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	); err != nil {
 		return err
 	}
+	if err := c.Watch(
+		&source.Kind{Type: &lighthousev1alpha1.LighthouseJob{}},
+		&handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(func(o handler.MapObject) []reconcile.Request {
+				var childList lighthousev1alpha1.LighthouseJobList
+				if err := r.client.List(nil, &childList, client.InNamespace(o.Meta.GetNamespace()), client.MatchingFields{rerunParentJobNameKey: o.Meta.GetName()}); err != nil {
+					r.logger.Errorf("Failed to list rerun jobs for parent %s: %s", o.Meta.GetName(), err)
+					return nil
+				}
+				var requests []ctrl.Request
+				for _, child := range childList.Items {
+					requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+						Name:      child.Name,
+						Namespace: child.Namespace,
+					}})
+				}
+				return requests
+			}),
+		},
+		predicate.ResourceVersionChangedPredicate{},
+	); err != nil {
+		return err
+	}
+	customTaskRun := &unstructured.Unstructured{}
+	customTaskRun.SetGroupVersionKind(schema.GroupVersionKind{Group: customTaskRunResource.Group, Version: customTaskRunResource.Version, Kind: "Run"})
+	if err := c.Watch(
+		&source.Kind{Type: customTaskRun},
+		&handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(func(o handler.MapObject) []reconcile.Request {
+				var jobList lighthousev1alpha1.LighthouseJobList
+				if err := r.client.List(nil, &jobList, client.InNamespace(o.Meta.GetNamespace()), client.MatchingFields{pipelineActivityKey: o.Meta.GetName()}); err != nil {
+					r.logger.Errorf("Failed to list jobs for Run %s: %s", o.Meta.GetName(), err)
+					return nil
+				}
+				var requests []ctrl.Request
+				for _, job := range jobList.Items {
+					requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+						Name:      job.Name,
+						Namespace: job.Namespace,
+					}})
+				}
+				return requests
+			}),
+		},
+		predicate.ResourceVersionChangedPredicate{},
+	); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -134,6 +221,10 @@ func (r *LighthouseJobReconciler) Reconcile(req ctrl.Request) (ctrl.Result, erro
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	if isCustomTaskJob(&job) {
+		return r.reconcileCustomTask(ctx, req, &job)
+	}
+
 	// filter on job agent
 	if job.Spec.Agent != configjob.JenkinsXAgent && job.Spec.Agent != configjob.LegacyDefaultAgent {
 		return ctrl.Result{}, nil
@@ -198,6 +289,28 @@ func (r *LighthouseJobReconciler) Reconcile(req ctrl.Request) (ctrl.Result, erro
 				EnvVariables: job.Spec.GetEnvVars(),
 			}
 
+			var parentJob *lighthousev1alpha1.LighthouseJob
+			if isRerun(&job) {
+				var err error
+				parentJob, err = r.getParentJob(ctx, req.Namespace, &job)
+				if err != nil {
+					return ctrl.Result{}, err
+				}
+				if parentJob != nil {
+					if pipelineCreateParam.Labels == nil {
+						pipelineCreateParam.Labels = map[string]string{}
+					}
+					pipelineCreateParam.Labels[rerunOfLabel] = util.ToValidName(parentJob.Status.ActivityName)
+					// mpClient.Create always self-allocates a build number; there's no param for
+					// handing it one outright. UseActivityForNextBuildNumber is the closest real
+					// lever: it makes the allocator look at this branch/context's existing
+					// PipelineActivities (which by now includes the parent's) instead of the
+					// SourceRepository counter, so a rerun's build number comes from the same
+					// lineage as its parent rather than drifting onto an unrelated counter.
+					pipelineCreateParam.UseActivityForNextBuildNumber = true
+				}
+			}
+
 			activityKey, tektonCRDs, err := r.mpClient.Create(pipelineCreateParam)
 			if err != nil {
 				return ctrl.Result{}, errors.Wrap(err, "unable to create Tekton CRDs")
@@ -207,6 +320,13 @@ func (r *LighthouseJobReconciler) Reconcile(req ctrl.Request) (ctrl.Result, erro
 				ActivityName: util.ToValidName(activityKey.Name),
 				StartTime:    metav1.Now(),
 			}
+			resolved := resolveSource(r.branchSHAResolver, sourceURL, &job.Spec)
+			if pipelineRun := tektonCRDs.PipelineRun(); pipelineRun != nil {
+				resolved.PipelineRunName = pipelineRun.Name
+			}
+			if err := setResolvedSource(&job, resolved); err != nil {
+				r.logger.Errorf("Failed to record resolved source: %s", err)
+			}
 			if err := r.client.Status().Update(ctx, &job); err != nil {
 				r.logger.Errorf("Failed to update LighthouseJob status: %s", err)
 				return ctrl.Result{}, err
@@ -215,6 +335,14 @@ func (r *LighthouseJobReconciler) Reconcile(req ctrl.Request) (ctrl.Result, erro
 			if err != nil {
 				return ctrl.Result{}, errors.Wrap(err, "unable to apply Tekton CRDs")
 			}
+		} else if job.Status.State == lighthousev1alpha1.AbortedState {
+			// A stage job cancelled by reconcileStages is created directly in AbortedState and
+			// never gets a PipelineActivity of its own, so this is the only chance to fan the
+			// cancellation out to its own dependents.
+			if err := r.reconcileStages(ctx, req.Namespace, &job); err != nil {
+				r.logger.Errorf("Failed to reconcile stages for %s: %s", job.Name, err)
+				return ctrl.Result{}, err
+			}
 		}
 	} else if len(pipelineActivityList.Items) == 1 {
 		// if pipeline run exists, create it and update status
@@ -229,8 +357,29 @@ func (r *LighthouseJobReconciler) Reconcile(req ctrl.Request) (ctrl.Result, erro
 		if err != nil {
 			return ctrl.Result{}, err
 		}
+		if resolved, err := getResolvedSource(&job); err != nil {
+			r.logger.Errorf("Failed to read resolved source: %s", err)
+		} else if resolved != nil {
+			applyResolvedSource(activityRecord, resolved)
+			r.logger.WithFields(logrus.Fields(map[string]interface{}{
+				"SourceURL":       resolved.SourceURL,
+				"BaseSHA":         resolved.BaseSHA,
+				"PipelineRunName": resolved.PipelineRunName,
+			})).Info("resolved source for this PipelineActivity")
+		}
+		skipStatusUpdate := false
+		if isRerun(&job) {
+			parentJob, err := r.getParentJob(ctx, req.Namespace, &job)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if parentJob != nil {
+				fillInFromParent(activityRecord, parentJob)
+			}
+			skipStatusUpdate = !rerunStatusUpdateEnabled()
+		}
 		urlBase := getReportURLBase()
-		if urlBase != "" {
+		if urlBase != "" && !skipStatusUpdate {
 			urlTeam := getReportURLTeam()
 			team := r.namespace
 			// override with env var if set
@@ -259,10 +408,17 @@ func (r *LighthouseJobReconciler) Reconcile(req ctrl.Request) (ctrl.Result, erro
 			}
 		}
 		job.Status.Activity = activityRecord
+		job.Status.State = activityRecord.Status
 		if err := r.client.Status().Update(ctx, &job); err != nil {
 			r.logger.Errorf("Failed to update LighthouseJob status: %s", err)
 			return ctrl.Result{}, err
 		}
+		if job.Status.State == lighthousev1alpha1.SuccessState || job.Status.State == lighthousev1alpha1.FailureState {
+			if err := r.reconcileStages(ctx, req.Namespace, &job); err != nil {
+				r.logger.Errorf("Failed to reconcile stages for %s: %s", job.Name, err)
+				return ctrl.Result{}, err
+			}
+		}
 	} else {
 		r.logger.Errorf("A lighthouse job should never have more than 1 pipeline activity")
 	}
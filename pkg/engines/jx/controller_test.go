@@ -77,6 +77,26 @@ func (f *fakeMetapipelineClient) Close() error {
 	return nil
 }
 
+// fakeCustomTaskClient is unused by the metapipeline-backed test cases below; it only exists so
+// NewLighthouseJobReconciler has a non-nil CustomTaskClient to work with.
+type fakeCustomTaskClient struct{}
+
+func (f *fakeCustomTaskClient) Create(param CustomTaskCreateParam) (*CustomTaskRun, error) {
+	return nil, errors.New("fakeCustomTaskClient.Create not implemented")
+}
+
+func (f *fakeCustomTaskClient) Get(namespace, name string) (*CustomTaskRun, error) {
+	return nil, errors.New("fakeCustomTaskClient.Get not implemented")
+}
+
+// fakeBranchSHAResolver is a no-op BranchSHAResolver for tests that don't exercise source
+// resolution; it leaves the base ref exactly as resolveSource found it.
+type fakeBranchSHAResolver struct{}
+
+func (f *fakeBranchSHAResolver) ResolveBranchSHA(sourceURL, branch string) (string, error) {
+	return "", errors.New("fakeBranchSHAResolver.ResolveBranchSHA not implemented")
+}
+
 func TestReconcile(t *testing.T) {
 	origBase := os.Getenv(baseTargetURLEnvVar)
 	origTeam := os.Getenv(targetURLTeamEnvVar)
@@ -142,7 +162,7 @@ func TestReconcile(t *testing.T) {
 				client:   c,
 				ns:       ns,
 			}
-			reconciler, err := NewLighthouseJobReconciler(c, scheme, ns, mpc)
+			reconciler, err := NewLighthouseJobReconciler(c, scheme, ns, mpc, &fakeCustomTaskClient{}, &fakeBranchSHAResolver{})
 			assert.NoError(t, err)
 
 			// invoke reconcile
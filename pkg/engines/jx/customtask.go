@@ -0,0 +1,286 @@
+package jx
+
+import (
+	"context"
+
+	lighthousev1alpha1 "github.com/jenkins-x/lighthouse/pkg/apis/lighthouse/v1alpha1"
+	configjob "github.com/jenkins-x/lighthouse/pkg/config/job"
+	"github.com/pkg/errors"
+	tektonv1beta1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"knative.dev/pkg/apis"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// customTaskRunResource is the GroupVersionResource of the tekton.dev Run custom resource that
+// backs CustomTaskRun.
+var customTaskRunResource = schema.GroupVersionResource{
+	Group:    "tekton.dev",
+	Version:  "v1alpha1",
+	Resource: "runs",
+}
+
+const (
+	// CustomTaskAgent is the conventional agent value job configs set PipelineRunSpec.PipelineRef/
+	// TaskRef style params under; customTaskAnnotation is what actually routes the job.
+	CustomTaskAgent = "custom-task"
+
+	// customTaskAnnotation marks a LighthouseJob for custom-task execution via reconcileCustomTask.
+	customTaskAnnotation = "lighthouse.jenkins-x.io/customTask"
+)
+
+// CustomTaskCreateParam wraps all parameters needed for creating a Run resource for a
+// CustomTaskAgent job, mirroring the role metapipeline.PipelineCreateParam plays for the
+// metapipeline backend.
+type CustomTaskCreateParam struct {
+	// Name and Namespace identify the LighthouseJob the Run is created for.
+	Name      string
+	Namespace string
+
+	// TaskRef/PipelineRef reference the custom task or pipeline to run. Exactly one should be set.
+	TaskRef     *tektonv1beta1.TaskRef
+	PipelineRef *tektonv1beta1.PipelineRef
+
+	// Params are forwarded from LighthouseJobSpec.PipelineRunParams.
+	Params []configjob.PipelineRunParam
+
+	// PipelineParams, Workspaces and ServiceAccountName are forwarded from
+	// LighthouseJobSpec.PipelineRunSpec.
+	PipelineParams     []tektonv1beta1.Param
+	Workspaces         []tektonv1beta1.WorkspaceBinding
+	ServiceAccountName string
+
+	// Labels are applied to the generated Run, mirroring PipelineCreateParam.Labels.
+	Labels map[string]string
+}
+
+// CustomTaskRunSpec is the desired state of a CustomTaskRun, mirroring tekton.dev/v1alpha1 Run's
+// spec: a reference to the custom task to execute plus the params to pass it.
+type CustomTaskRunSpec struct {
+	TaskRef            *tektonv1beta1.TaskRef           `json:"taskRef,omitempty"`
+	PipelineRef        *tektonv1beta1.PipelineRef       `json:"pipelineRef,omitempty"`
+	Params             []configjob.PipelineRunParam     `json:"params,omitempty"`
+	PipelineParams     []tektonv1beta1.Param            `json:"pipelineParams,omitempty"`
+	Workspaces         []tektonv1beta1.WorkspaceBinding `json:"workspaces,omitempty"`
+	ServiceAccountName string                           `json:"serviceAccountName,omitempty"`
+}
+
+// CustomTaskRunStatus is the observed state of a CustomTaskRun.
+type CustomTaskRunStatus struct {
+	// Conditions mirrors the knative-style Succeeded/Failed condition tracked by Tekton Runs.
+	Conditions []apis.Condition `json:"conditions,omitempty"`
+	// Results holds the named outputs the custom task controller reported on completion.
+	Results []CustomTaskRunResult `json:"results,omitempty"`
+}
+
+// CustomTaskRunResult is a single named result reported by a custom task controller.
+type CustomTaskRunResult struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// CustomTaskRun is the subset of the tekton.dev/v1alpha1 Run custom resource this controller
+// needs to create and watch.
+type CustomTaskRun struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CustomTaskRunSpec   `json:"spec,omitempty"`
+	Status CustomTaskRunStatus `json:"status,omitempty"`
+}
+
+// CustomTaskClient creates and reads back Tekton Custom Task Run resources.
+type CustomTaskClient interface {
+	// Create creates the Run resource described by param.
+	Create(param CustomTaskCreateParam) (*CustomTaskRun, error)
+
+	// Get fetches the current state of a previously created Run.
+	Get(namespace, name string) (*CustomTaskRun, error)
+}
+
+// dynamicCustomTaskClient is the default CustomTaskClient implementation, backed by a dynamic
+// client so this controller doesn't need a generated/typed client for the tekton.dev Run CRD.
+type dynamicCustomTaskClient struct {
+	dynamic dynamic.Interface
+}
+
+// NewCustomTaskClient creates a CustomTaskClient for the given namespace.
+func NewCustomTaskClient(namespace string) (CustomTaskClient, error) {
+	cfg, err := config.GetConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load kubeconfig")
+	}
+	dynamicClient, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create dynamic client")
+	}
+	return &dynamicCustomTaskClient{dynamic: dynamicClient}, nil
+}
+
+func (c *dynamicCustomTaskClient) Create(param CustomTaskCreateParam) (*CustomTaskRun, error) {
+	run := &CustomTaskRun{
+		TypeMeta: metav1.TypeMeta{APIVersion: "tekton.dev/v1alpha1", Kind: "Run"},
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: param.Name + "-",
+			Namespace:    param.Namespace,
+			Labels:       param.Labels,
+		},
+		Spec: CustomTaskRunSpec{
+			TaskRef:            param.TaskRef,
+			PipelineRef:        param.PipelineRef,
+			Params:             param.Params,
+			PipelineParams:     param.PipelineParams,
+			Workspaces:         param.Workspaces,
+			ServiceAccountName: param.ServiceAccountName,
+		},
+	}
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(run)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to convert Run to unstructured")
+	}
+	created, err := c.dynamic.Resource(customTaskRunResource).Namespace(param.Namespace).
+		Create(&unstructured.Unstructured{Object: obj}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create Run")
+	}
+	return runFromUnstructured(created)
+}
+
+func (c *dynamicCustomTaskClient) Get(namespace, name string) (*CustomTaskRun, error) {
+	obj, err := c.dynamic.Resource(customTaskRunResource).Namespace(namespace).
+		Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get Run")
+	}
+	return runFromUnstructured(obj)
+}
+
+// runFromUnstructured converts a Run fetched through the dynamic client back into a CustomTaskRun.
+func runFromUnstructured(obj *unstructured.Unstructured) (*CustomTaskRun, error) {
+	run := &CustomTaskRun{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, run); err != nil {
+		return nil, errors.Wrap(err, "failed to convert unstructured Run")
+	}
+	return run, nil
+}
+
+// isCustomTaskJob returns true if the job should be executed as a Tekton Custom Task rather
+// than through the metapipeline.
+func isCustomTaskJob(job *lighthousev1alpha1.LighthouseJob) bool {
+	return job.Annotations[customTaskAnnotation] == "true"
+}
+
+// customTaskRefFromSpec works out the TaskRef/PipelineRef a Run should use. A PipelineRef
+// forwarded on PipelineRunSpec takes precedence; otherwise the job name is used to build a TaskRef.
+func customTaskRefFromSpec(spec *lighthousev1alpha1.LighthouseJobSpec) (*tektonv1beta1.TaskRef, *tektonv1beta1.PipelineRef) {
+	if spec.PipelineRunSpec != nil && spec.PipelineRunSpec.PipelineRef != nil {
+		return nil, spec.PipelineRunSpec.PipelineRef
+	}
+	return &tektonv1beta1.TaskRef{Name: spec.Job}, nil
+}
+
+// succeededCondition returns the Succeeded condition from a Run's status, if set.
+func succeededCondition(status CustomTaskRunStatus) *apis.Condition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == apis.ConditionSucceeded {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// activityRecordFromCustomTaskRun synthesizes an ActivityRecord-equivalent state from a Run's
+// status and step results, the same way ConvertPipelineActivity does for a PipelineActivity.
+func activityRecordFromCustomTaskRun(run *CustomTaskRun) (*lighthousev1alpha1.ActivityRecord, error) {
+	if run == nil {
+		return nil, errors.New("no CustomTaskRun to convert")
+	}
+	record := &lighthousev1alpha1.ActivityRecord{
+		Name: run.Name,
+	}
+	condition := succeededCondition(run.Status)
+	if condition == nil {
+		record.Status = lighthousev1alpha1.RunningState
+		return record, nil
+	}
+	switch condition.Status {
+	case corev1.ConditionTrue:
+		record.Status = lighthousev1alpha1.SuccessState
+	case corev1.ConditionFalse:
+		record.Status = lighthousev1alpha1.FailureState
+	default:
+		record.Status = lighthousev1alpha1.RunningState
+	}
+	for _, result := range run.Status.Results {
+		record.Steps = append(record.Steps, &lighthousev1alpha1.ActivityStageOrStep{
+			Name:   result.Name,
+			Status: record.Status,
+		})
+	}
+	return record, nil
+}
+
+// reconcileCustomTask handles Reconcile's work for a CustomTaskAgent job: creating the Run on
+// first sight of a triggered job, then reading back its status on subsequent reconciles.
+func (r *LighthouseJobReconciler) reconcileCustomTask(ctx context.Context, req ctrl.Request, job *lighthousev1alpha1.LighthouseJob) (ctrl.Result, error) {
+	if job.Status.ActivityName == "" {
+		if job.Status.State != lighthousev1alpha1.TriggeredState {
+			return ctrl.Result{}, nil
+		}
+
+		taskRef, pipelineRef := customTaskRefFromSpec(&job.Spec)
+		createParam := CustomTaskCreateParam{
+			Name:        job.Name,
+			Namespace:   req.Namespace,
+			TaskRef:     taskRef,
+			PipelineRef: pipelineRef,
+			Params:      job.Spec.PipelineRunParams,
+		}
+		if runSpec := job.Spec.PipelineRunSpec; runSpec != nil {
+			createParam.PipelineParams = runSpec.Params
+			createParam.Workspaces = runSpec.Workspaces
+			createParam.ServiceAccountName = runSpec.ServiceAccountName
+		}
+		run, err := r.customTaskClient.Create(createParam)
+		if err != nil {
+			return ctrl.Result{}, errors.Wrap(err, "unable to create Tekton Run")
+		}
+
+		job.Status = lighthousev1alpha1.LighthouseJobStatus{
+			State:        lighthousev1alpha1.PendingState,
+			ActivityName: run.Name,
+			StartTime:    metav1.Now(),
+		}
+		if err := r.client.Status().Update(ctx, job); err != nil {
+			r.logger.Errorf("Failed to update LighthouseJob status: %s", err)
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	run, err := r.customTaskClient.Get(req.Namespace, job.Status.ActivityName)
+	if err != nil {
+		return ctrl.Result{}, errors.Wrap(err, "unable to get Tekton Run")
+	}
+	activityRecord, err := activityRecordFromCustomTaskRun(run)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	job.Status.Activity = activityRecord
+	if condition := succeededCondition(run.Status); condition != nil && condition.Status != corev1.ConditionUnknown {
+		job.Status.State = activityRecord.Status
+		completionTime := condition.LastTransitionTime.Inner
+		job.Status.CompletionTime = &completionTime
+	}
+	if err := r.client.Status().Update(ctx, job); err != nil {
+		r.logger.Errorf("Failed to update LighthouseJob status: %s", err)
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
@@ -0,0 +1,141 @@
+package jx
+
+import (
+	"context"
+	"testing"
+
+	jxv1 "github.com/jenkins-x/jx-api/pkg/apis/jenkins.io/v1"
+	lighthousev1alpha1 "github.com/jenkins-x/lighthouse/pkg/apis/lighthouse/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	tektonv1beta1 "github.com/tektoncd/pipeline/pkg/apis/pipeline/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"knative.dev/pkg/apis"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const customTaskTestNamespace = "jx"
+
+// capturingCustomTaskClient records the CustomTaskCreateParam it was last called with, so tests
+// can assert on exactly what reconcileCustomTask forwarded into it.
+type capturingCustomTaskClient struct {
+	lastCreateParam CustomTaskCreateParam
+	run             *CustomTaskRun
+}
+
+func (c *capturingCustomTaskClient) Create(param CustomTaskCreateParam) (*CustomTaskRun, error) {
+	c.lastCreateParam = param
+	if c.run != nil {
+		return c.run, nil
+	}
+	return &CustomTaskRun{ObjectMeta: metav1.ObjectMeta{Name: param.Name + "-abcde"}}, nil
+}
+
+func (c *capturingCustomTaskClient) Get(namespace, name string) (*CustomTaskRun, error) {
+	return nil, errors.New("capturingCustomTaskClient.Get not implemented")
+}
+
+func newCustomTaskTestReconciler(t *testing.T, customTaskClient CustomTaskClient, initObjs ...runtime.Object) *LighthouseJobReconciler {
+	scheme := runtime.NewScheme()
+	err := lighthousev1alpha1.AddToScheme(scheme)
+	assert.NoError(t, err)
+	err = jxv1.AddToScheme(scheme)
+	assert.NoError(t, err)
+	c := fake.NewFakeClientWithScheme(scheme, initObjs...)
+	reconciler, err := NewLighthouseJobReconciler(c, scheme, customTaskTestNamespace, &fakeMetapipelineClient{}, customTaskClient, &fakeBranchSHAResolver{})
+	assert.NoError(t, err)
+	return reconciler
+}
+
+// TestReconcileCustomTaskForwardsPipelineRunSpec verifies that reconcileCustomTask forwards
+// Params, Workspaces and ServiceAccountName from LighthouseJobSpec.PipelineRunSpec into the
+// created Run, not just PipelineRef/TaskRef.
+func TestReconcileCustomTaskForwardsPipelineRunSpec(t *testing.T) {
+	job := &lighthousev1alpha1.LighthouseJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "custom-task-job",
+			Namespace: customTaskTestNamespace,
+			Annotations: map[string]string{
+				customTaskAnnotation: "true",
+			},
+		},
+		Spec: lighthousev1alpha1.LighthouseJobSpec{
+			PipelineRunSpec: &tektonv1beta1.PipelineRunSpec{
+				PipelineRef:        &tektonv1beta1.PipelineRef{Name: "some-pipeline"},
+				Params:             []tektonv1beta1.Param{{Name: "env"}},
+				Workspaces:         []tektonv1beta1.WorkspaceBinding{{Name: "shared-data"}},
+				ServiceAccountName: "build-bot",
+			},
+		},
+		Status: lighthousev1alpha1.LighthouseJobStatus{
+			State: lighthousev1alpha1.TriggeredState,
+		},
+	}
+	client := &capturingCustomTaskClient{}
+	reconciler := newCustomTaskTestReconciler(t, client, job)
+
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: job.Namespace, Name: job.Name}}
+	_, err := reconciler.reconcileCustomTask(context.Background(), req, job)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []tektonv1beta1.Param{{Name: "env"}}, client.lastCreateParam.PipelineParams)
+	assert.Equal(t, []tektonv1beta1.WorkspaceBinding{{Name: "shared-data"}}, client.lastCreateParam.Workspaces)
+	assert.Equal(t, "build-bot", client.lastCreateParam.ServiceAccountName)
+}
+
+// TestCustomTaskRefFromSpecPrefersPipelineRef verifies customTaskRefFromSpec's documented
+// precedence: a PipelineRef on PipelineRunSpec wins over the job-name-derived TaskRef fallback.
+func TestCustomTaskRefFromSpecPrefersPipelineRef(t *testing.T) {
+	spec := &lighthousev1alpha1.LighthouseJobSpec{
+		Job: "some-job",
+		PipelineRunSpec: &tektonv1beta1.PipelineRunSpec{
+			PipelineRef: &tektonv1beta1.PipelineRef{Name: "some-pipeline"},
+		},
+	}
+	taskRef, pipelineRef := customTaskRefFromSpec(spec)
+	assert.Nil(t, taskRef)
+	if assert.NotNil(t, pipelineRef) {
+		assert.Equal(t, "some-pipeline", pipelineRef.Name)
+	}
+}
+
+// TestCustomTaskRefFromSpecFallsBackToJobName verifies customTaskRefFromSpec's fallback: with no
+// PipelineRef set, it builds a TaskRef from the job name, following the same convention the
+// metapipeline backend uses to name its Tekton Task.
+func TestCustomTaskRefFromSpecFallsBackToJobName(t *testing.T) {
+	spec := &lighthousev1alpha1.LighthouseJobSpec{
+		Job: "some-job",
+	}
+	taskRef, pipelineRef := customTaskRefFromSpec(spec)
+	assert.Nil(t, pipelineRef)
+	if assert.NotNil(t, taskRef) {
+		assert.Equal(t, "some-job", taskRef.Name)
+	}
+}
+
+// TestActivityRecordFromCustomTaskRunResult verifies that a CustomTaskRun's reported results and
+// Succeeded condition are converted into the Steps/Status an ActivityRecord is expected to carry,
+// the same way ConvertPipelineActivity does for a PipelineActivity.
+func TestActivityRecordFromCustomTaskRunResult(t *testing.T) {
+	run := &CustomTaskRun{
+		ObjectMeta: metav1.ObjectMeta{Name: "custom-task-job-abcde"},
+		Status: CustomTaskRunStatus{
+			Conditions: []apis.Condition{
+				{Type: apis.ConditionSucceeded, Status: corev1.ConditionTrue},
+			},
+			Results: []CustomTaskRunResult{
+				{Name: "output", Value: "ok"},
+			},
+		},
+	}
+	record, err := activityRecordFromCustomTaskRun(run)
+	assert.NoError(t, err)
+	assert.Equal(t, lighthousev1alpha1.SuccessState, record.Status)
+	if assert.Len(t, record.Steps, 1) {
+		assert.Equal(t, "output", record.Steps[0].Name)
+	}
+}
@@ -0,0 +1,65 @@
+package jx
+
+import (
+	"github.com/jenkins-x/jx/v2/pkg/auth"
+	"github.com/jenkins-x/jx/v2/pkg/gits"
+	"github.com/jenkins-x/jx/v2/pkg/util"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+)
+
+// kindSecretName is the Kubernetes secret kind git credentials are stored under.
+const kindSecretName = "jx-auth"
+
+// BranchSHAResolver resolves a base ref that may be a branch name, or empty for the repository's
+// default branch, into the concrete commit SHA it currently points at.
+type BranchSHAResolver interface {
+	// ResolveBranchSHA returns the current HEAD commit SHA of branch in the repo at sourceURL.
+	ResolveBranchSHA(sourceURL, branch string) (string, error)
+}
+
+// gitProviderBranchSHAResolver is the default BranchSHAResolver, looking the branch up through
+// the git provider for sourceURL's host.
+type gitProviderBranchSHAResolver struct {
+	namespace  string
+	kubeClient kubernetes.Interface
+}
+
+// NewBranchSHAResolver creates a BranchSHAResolver backed by the git server configuration stored
+// in namespace.
+func NewBranchSHAResolver(namespace string) (BranchSHAResolver, error) {
+	cfg, err := config.GetConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load kubeconfig")
+	}
+	kubeClient, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create kube client")
+	}
+	return &gitProviderBranchSHAResolver{namespace: namespace, kubeClient: kubeClient}, nil
+}
+
+// ResolveBranchSHA implements BranchSHAResolver.
+func (r *gitProviderBranchSHAResolver) ResolveBranchSHA(sourceURL, branch string) (string, error) {
+	gitInfo, err := gits.ParseGitURL(sourceURL)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse git URL")
+	}
+	authConfigSvc := auth.NewKubeAuthConfigService(r.kubeClient, r.namespace, kindSecretName, "git")
+	provider, err := gits.CreateProviderForURL(true, authConfigSvc, "", gitInfo.HostURL(), gitInfo.Organisation, nil, true, util.IOFileHandles{})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create git provider")
+	}
+	if branch == "" {
+		branch = "master"
+	}
+	gitBranch, err := provider.GetBranch(gitInfo.Organisation, gitInfo.Name, branch)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to resolve branch %s", branch)
+	}
+	if gitBranch == nil || gitBranch.Commit == nil {
+		return "", errors.Errorf("no commit found for branch %s of %s", branch, sourceURL)
+	}
+	return gitBranch.Commit.SHA, nil
+}
@@ -0,0 +1,102 @@
+package jx
+
+import (
+	"encoding/json"
+	"strings"
+
+	lighthousev1alpha1 "github.com/jenkins-x/lighthouse/pkg/apis/lighthouse/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// resolvedSourceAnnotation records the concrete git source a LighthouseJob's pipeline was
+// dispatched against, as JSON-encoded ResolvedSource.
+const resolvedSourceAnnotation = "lighthouse.jenkins-x.io/resolvedSource"
+
+// ResolvedSource is the concrete git state a pipeline was actually dispatched against.
+type ResolvedSource struct {
+	// SourceURL is the git clone URL the pipeline was run against.
+	SourceURL string `json:"sourceURL"`
+	// BaseSHA is the resolved base branch commit SHA at dispatch time.
+	BaseSHA string `json:"baseSHA"`
+	// Pulls holds each pull request's head SHA at the moment the pipeline was dispatched.
+	Pulls []ResolvedPullRef `json:"pulls,omitempty"`
+	// PipelineRunName is the Tekton PipelineRun this dispatch produced.
+	PipelineRunName string `json:"pipelineRunName"`
+}
+
+// ResolvedPullRef is a pull request's head SHA at the moment its pipeline was dispatched.
+type ResolvedPullRef struct {
+	Number int    `json:"number"`
+	SHA    string `json:"sha"`
+}
+
+// resolveSource snapshots the git source a job about to be dispatched will actually build. If
+// spec.Refs.BaseSHA isn't already a concrete commit, resolver looks up the real HEAD commit.
+func resolveSource(resolver BranchSHAResolver, sourceURL string, spec *lighthousev1alpha1.LighthouseJobSpec) *ResolvedSource {
+	resolved := &ResolvedSource{
+		SourceURL: sourceURL,
+		BaseSHA:   spec.Refs.BaseSHA,
+	}
+	if !isLikelyCommitSHA(resolved.BaseSHA) && resolver != nil {
+		branch := spec.Refs.BaseRef
+		if sha, err := resolver.ResolveBranchSHA(sourceURL, branch); err != nil {
+			logrus.WithError(err).Warnf("failed to resolve base SHA for branch %q of %s", branch, sourceURL)
+		} else {
+			resolved.BaseSHA = sha
+		}
+	}
+	for _, pull := range spec.Refs.Pulls {
+		resolved.Pulls = append(resolved.Pulls, ResolvedPullRef{Number: pull.Number, SHA: pull.SHA})
+	}
+	return resolved
+}
+
+// isLikelyCommitSHA reports whether s looks like a concrete git commit SHA rather than a branch
+// name or empty ref.
+func isLikelyCommitSHA(s string) bool {
+	if len(s) < 7 {
+		return false
+	}
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyResolvedSource carries a job's resolved source snapshot onto its activity record.
+// LastCommitSHA is populated from the first pull, the closest existing field to "pull head SHA".
+func applyResolvedSource(activityRecord *lighthousev1alpha1.ActivityRecord, resolved *ResolvedSource) {
+	activityRecord.BaseSHA = resolved.BaseSHA
+	if len(resolved.Pulls) > 0 {
+		activityRecord.LastCommitSHA = resolved.Pulls[0].SHA
+	}
+}
+
+// setResolvedSource records resolved on job as resolvedSourceAnnotation.
+func setResolvedSource(job *lighthousev1alpha1.LighthouseJob, resolved *ResolvedSource) error {
+	data, err := json.Marshal(resolved)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal resolved source")
+	}
+	if job.Annotations == nil {
+		job.Annotations = map[string]string{}
+	}
+	job.Annotations[resolvedSourceAnnotation] = string(data)
+	return nil
+}
+
+// getResolvedSource reads back the ResolvedSource previously recorded on job, if any.
+func getResolvedSource(job *lighthousev1alpha1.LighthouseJob) (*ResolvedSource, error) {
+	data, ok := job.Annotations[resolvedSourceAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	resolved := &ResolvedSource{}
+	if err := json.Unmarshal([]byte(data), resolved); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal resolved source")
+	}
+	return resolved, nil
+}
@@ -0,0 +1,88 @@
+package jx
+
+import (
+	"testing"
+
+	lighthousev1alpha1 "github.com/jenkins-x/lighthouse/pkg/apis/lighthouse/v1alpha1"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveSourceRoundTrip(t *testing.T) {
+	spec := &lighthousev1alpha1.LighthouseJobSpec{
+		Refs: &lighthousev1alpha1.Refs{
+			BaseSHA: "abc1234",
+			Pulls: []lighthousev1alpha1.Pull{
+				{Number: 42, SHA: "def5678"},
+			},
+		},
+	}
+	resolved := resolveSource(nil, "https://github.com/example/repo.git", spec)
+	resolved.PipelineRunName = "some-pipelinerun"
+
+	job := &lighthousev1alpha1.LighthouseJob{}
+	err := setResolvedSource(job, resolved)
+	assert.NoError(t, err)
+
+	roundTripped, err := getResolvedSource(job)
+	assert.NoError(t, err)
+	assert.Equal(t, resolved, roundTripped)
+}
+
+func TestGetResolvedSourceAbsent(t *testing.T) {
+	job := &lighthousev1alpha1.LighthouseJob{}
+	resolved, err := getResolvedSource(job)
+	assert.NoError(t, err)
+	assert.Nil(t, resolved)
+}
+
+type fakeBranchSHAResolverForTest struct {
+	sha string
+	err error
+}
+
+func (f *fakeBranchSHAResolverForTest) ResolveBranchSHA(sourceURL, branch string) (string, error) {
+	return f.sha, f.err
+}
+
+func TestResolveSourceResolvesBranchName(t *testing.T) {
+	spec := &lighthousev1alpha1.LighthouseJobSpec{
+		Refs: &lighthousev1alpha1.Refs{
+			BaseRef: "master",
+		},
+	}
+	resolved := resolveSource(&fakeBranchSHAResolverForTest{sha: "0123456789abcdef0123456789abcdef01234567"}, "https://github.com/example/repo.git", spec)
+	assert.Equal(t, "0123456789abcdef0123456789abcdef01234567", resolved.BaseSHA)
+}
+
+// TestApplyResolvedSourceRerunDifferentSHA covers a rerun whose resolved source ends up pointing
+// at a different commit than the one recorded on the activity record it's updating - e.g. because
+// the branch tip moved between the original run and the rerun - to verify the resolved SHA always
+// wins rather than being silently dropped.
+func TestApplyResolvedSourceRerunDifferentSHA(t *testing.T) {
+	activityRecord := &lighthousev1alpha1.ActivityRecord{
+		BaseSHA: "originalsha0000000000000000000000000000",
+	}
+	resolved := &ResolvedSource{
+		BaseSHA: "rerunresolvedsha000000000000000000000000",
+		Pulls: []ResolvedPullRef{
+			{Number: 42, SHA: "pullheadsha0000000000000000000000000000"},
+		},
+	}
+
+	applyResolvedSource(activityRecord, resolved)
+
+	assert.Equal(t, "rerunresolvedsha000000000000000000000000", activityRecord.BaseSHA)
+	assert.Equal(t, "pullheadsha0000000000000000000000000000", activityRecord.LastCommitSHA)
+}
+
+func TestResolveSourceKeepsConcreteSHA(t *testing.T) {
+	spec := &lighthousev1alpha1.LighthouseJobSpec{
+		Refs: &lighthousev1alpha1.Refs{
+			BaseSHA: "0123456789abcdef0123456789abcdef01234567",
+		},
+	}
+	resolver := &fakeBranchSHAResolverForTest{err: errors.New("should not be called")}
+	resolved := resolveSource(resolver, "https://github.com/example/repo.git", spec)
+	assert.Equal(t, spec.Refs.BaseSHA, resolved.BaseSHA)
+}
@@ -0,0 +1,79 @@
+package jx
+
+import (
+	"context"
+	"os"
+
+	lighthousev1alpha1 "github.com/jenkins-x/lighthouse/pkg/apis/lighthouse/v1alpha1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// rerunAnnotation marks a LighthouseJob as a request to rerun an existing job.
+	rerunAnnotation = "lighthouse.jenkins-x.io/rerun"
+	// parentJobNameAnnotation points a rerun LighthouseJob at the LighthouseJob it reruns.
+	parentJobNameAnnotation = "lighthouse.jenkins-x.io/parentJobName"
+	// rerunOfLabel points a rerun's generated CRDs back to the PipelineActivity they rerun.
+	rerunOfLabel = "lighthouse.jenkins-x.io/rerun-of"
+	// enableRerunStatusUpdateEnvVar gates whether reruns re-post the git provider status update.
+	enableRerunStatusUpdateEnvVar = "LIGHTHOUSE_ENABLE_RERUN_STATUS_UPDATE"
+	// rerunParentJobNameKey indexes LighthouseJobs by the parent job they rerun.
+	rerunParentJobNameKey = ".metadata.rerunParentJobName"
+)
+
+// isRerun returns true if the job is either explicitly annotated as a rerun or references a
+// parent job to rerun.
+func isRerun(job *lighthousev1alpha1.LighthouseJob) bool {
+	return job.Annotations[rerunAnnotation] == "true" || parentJobName(job) != ""
+}
+
+// parentJobName returns the name of the LighthouseJob this job reruns, if any.
+func parentJobName(job *lighthousev1alpha1.LighthouseJob) string {
+	return job.Annotations[parentJobNameAnnotation]
+}
+
+// rerunStatusUpdateEnabled reports whether the git provider status update step should run for reruns.
+func rerunStatusUpdateEnabled() bool {
+	return os.Getenv(enableRerunStatusUpdateEnvVar) == "true"
+}
+
+// getParentJob looks up the LighthouseJob a rerun job references, returning nil if the job isn't
+// a rerun or its parent can't be found.
+func (r *LighthouseJobReconciler) getParentJob(ctx context.Context, namespace string, job *lighthousev1alpha1.LighthouseJob) (*lighthousev1alpha1.LighthouseJob, error) {
+	parent := parentJobName(job)
+	if parent == "" {
+		return nil, nil
+	}
+	var parentJob lighthousev1alpha1.LighthouseJob
+	if err := r.client.Get(ctx, types.NamespacedName{Namespace: namespace, Name: parent}, &parentJob); err != nil {
+		if client.IgnoreNotFound(err) == nil {
+			r.logger.Warningf("Parent job %s for rerun %s not found", parent, job.Name)
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to get parent job %s", parent)
+	}
+	return &parentJob, nil
+}
+
+// fillInFromParent preserves the parent job's ReportURL template inputs on a rerun's activity
+// record wherever the rerun's own record doesn't have them yet.
+func fillInFromParent(activityRecord *lighthousev1alpha1.ActivityRecord, parentJob *lighthousev1alpha1.LighthouseJob) {
+	parentActivity := parentJob.Status.Activity
+	if parentActivity == nil {
+		return
+	}
+	if activityRecord.Owner == "" {
+		activityRecord.Owner = parentActivity.Owner
+	}
+	if activityRecord.Repo == "" {
+		activityRecord.Repo = parentActivity.Repo
+	}
+	if activityRecord.Branch == "" {
+		activityRecord.Branch = parentActivity.Branch
+	}
+	if activityRecord.Context == "" {
+		activityRecord.Context = parentActivity.Context
+	}
+}
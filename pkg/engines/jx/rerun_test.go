@@ -0,0 +1,128 @@
+package jx
+
+import (
+	"testing"
+
+	jxv1 "github.com/jenkins-x/jx-api/pkg/apis/jenkins.io/v1"
+	jxfake "github.com/jenkins-x/jx-api/pkg/client/clientset/versioned/fake"
+	"github.com/jenkins-x/jx/v2/pkg/kube"
+	"github.com/jenkins-x/jx/v2/pkg/tekton"
+	"github.com/jenkins-x/jx/v2/pkg/tekton/metapipeline"
+	lighthousev1alpha1 "github.com/jenkins-x/lighthouse/pkg/apis/lighthouse/v1alpha1"
+	configjob "github.com/jenkins-x/lighthouse/pkg/config/job"
+	"github.com/jenkins-x/lighthouse/pkg/util"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const rerunTestNamespace = "jx"
+
+// capturingMetapipelineClient wraps fakeMetapipelineClient and records the
+// PipelineCreateParam it was last called with, so tests can assert on exactly what a rerun
+// forwarded into it.
+type capturingMetapipelineClient struct {
+	fakeMetapipelineClient
+	lastCreateParam metapipeline.PipelineCreateParam
+}
+
+func (c *capturingMetapipelineClient) Create(param metapipeline.PipelineCreateParam) (kube.PromoteStepActivityKey, tekton.CRDWrapper, error) {
+	c.lastCreateParam = param
+	return c.fakeMetapipelineClient.Create(param)
+}
+
+func rerunTestJob(name string) *lighthousev1alpha1.LighthouseJob {
+	return &lighthousev1alpha1.LighthouseJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: rerunTestNamespace,
+			Labels:    map[string]string{"app": "rerun-test"},
+		},
+		Spec: lighthousev1alpha1.LighthouseJobSpec{
+			Type:    configjob.PostsubmitJob,
+			Agent:   configjob.JenkinsXAgent,
+			Context: "ci",
+			Refs: &lighthousev1alpha1.Refs{
+				Org:      "acme",
+				Repo:     "demo",
+				CloneURI: "https://github.com/acme/demo.git",
+				BaseRef:  "master",
+				BaseSHA:  "abc1234",
+			},
+		},
+	}
+}
+
+// TestReconcileRerunAppliesParentLinkageOnCreate drives the branch of Reconcile that creates a
+// new PipelineActivity for a triggered rerun, and asserts that both halves of the parent linkage
+// actually take effect: the rerun-of label pointing back at the parent's activity, and
+// UseActivityForNextBuildNumber so the rerun's build number is allocated from the same lineage as
+// its parent rather than an unrelated counter.
+func TestReconcileRerunAppliesParentLinkageOnCreate(t *testing.T) {
+	parent := rerunTestJob("parent-job")
+	parent.Status.ActivityName = "parent-activity"
+
+	job := rerunTestJob("rerun-job")
+	job.Annotations = map[string]string{parentJobNameAnnotation: parent.Name}
+	job.Status.State = lighthousev1alpha1.TriggeredState
+
+	scheme := runtime.NewScheme()
+	assert.NoError(t, lighthousev1alpha1.AddToScheme(scheme))
+	assert.NoError(t, jxv1.AddToScheme(scheme))
+	c := fake.NewFakeClientWithScheme(scheme, job, parent)
+	mpc := &capturingMetapipelineClient{fakeMetapipelineClient: fakeMetapipelineClient{jxClient: jxfake.NewSimpleClientset(), client: c, ns: rerunTestNamespace}}
+	reconciler, err := NewLighthouseJobReconciler(c, scheme, rerunTestNamespace, mpc, &fakeCustomTaskClient{}, &fakeBranchSHAResolver{})
+	assert.NoError(t, err)
+
+	_, err = reconciler.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: rerunTestNamespace, Name: job.Name}})
+	assert.NoError(t, err)
+
+	assert.Equal(t, util.ToValidName(parent.Status.ActivityName), mpc.lastCreateParam.Labels[rerunOfLabel])
+	assert.True(t, mpc.lastCreateParam.UseActivityForNextBuildNumber)
+}
+
+// TestReconcileRerunFillsInFromParentActivity drives the branch of Reconcile that reads back an
+// already-created PipelineActivity, and asserts that fillInFromParent backfills the rerun's
+// activity record with the parent's owner/repo/branch/context wherever the rerun's own record
+// doesn't have them yet.
+func TestReconcileRerunFillsInFromParentActivity(t *testing.T) {
+	parent := rerunTestJob("parent-job")
+	parent.Status.Activity = &lighthousev1alpha1.ActivityRecord{
+		Owner:   "acme",
+		Repo:    "demo",
+		Branch:  "feature-x",
+		Context: "ci",
+	}
+
+	job := rerunTestJob("rerun-job")
+	job.Annotations = map[string]string{parentJobNameAnnotation: parent.Name}
+	job.Status.ActivityName = "rerun-job-activity"
+	job.Status.State = lighthousev1alpha1.PendingState
+
+	activity := &jxv1.PipelineActivity{
+		ObjectMeta: metav1.ObjectMeta{Name: job.Status.ActivityName, Namespace: rerunTestNamespace},
+	}
+
+	scheme := runtime.NewScheme()
+	assert.NoError(t, lighthousev1alpha1.AddToScheme(scheme))
+	assert.NoError(t, jxv1.AddToScheme(scheme))
+	c := fake.NewFakeClientWithScheme(scheme, job, parent, activity)
+	mpc := &fakeMetapipelineClient{jxClient: jxfake.NewSimpleClientset(), client: c, ns: rerunTestNamespace}
+	reconciler, err := NewLighthouseJobReconciler(c, scheme, rerunTestNamespace, mpc, &fakeCustomTaskClient{}, &fakeBranchSHAResolver{})
+	assert.NoError(t, err)
+
+	_, err = reconciler.Reconcile(ctrl.Request{NamespacedName: types.NamespacedName{Namespace: rerunTestNamespace, Name: job.Name}})
+	assert.NoError(t, err)
+
+	var updated lighthousev1alpha1.LighthouseJob
+	assert.NoError(t, c.Get(nil, types.NamespacedName{Namespace: rerunTestNamespace, Name: job.Name}, &updated))
+	if assert.NotNil(t, updated.Status.Activity) {
+		assert.Equal(t, parent.Status.Activity.Owner, updated.Status.Activity.Owner)
+		assert.Equal(t, parent.Status.Activity.Repo, updated.Status.Activity.Repo)
+		assert.Equal(t, parent.Status.Activity.Branch, updated.Status.Activity.Branch)
+		assert.Equal(t, parent.Status.Activity.Context, updated.Status.Activity.Context)
+	}
+}
@@ -0,0 +1,177 @@
+package jx
+
+import (
+	"context"
+	"encoding/json"
+
+	lighthousev1alpha1 "github.com/jenkins-x/lighthouse/pkg/apis/lighthouse/v1alpha1"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// stagesAnnotation carries the JSON-encoded stage DSL for a LighthouseJob.
+	stagesAnnotation = "lighthouse.jenkins-x.io/stages"
+	// stageNameAnnotation names the stage a job was created for.
+	stageNameAnnotation = "lighthouse.jenkins-x.io/stageName"
+	// stageRootJobNameAnnotation points every job in a stage graph at the root job's name.
+	stageRootJobNameAnnotation = "lighthouse.jenkins-x.io/stageRootJobName"
+	// stagePredecessorAnnotation points a stage job at the job it was fanned out from.
+	stagePredecessorAnnotation = "lighthouse.jenkins-x.io/stagePredecessor"
+	// rootStageName is the synthetic stage name representing the root job itself.
+	rootStageName = ""
+	// stageRootJobNameKey indexes LighthouseJobs by the root job of their stage graph.
+	stageRootJobNameKey = ".metadata.stageRootJobName"
+)
+
+// Stage is one node of a LighthouseJob's stage graph: the job to run and the stages, by name,
+// that must succeed first. A Stage with no DependsOn runs once the root job succeeds.
+type Stage struct {
+	Name      string   `json:"name"`
+	Job       string   `json:"job"`
+	DependsOn []string `json:"dependsOn,omitempty"`
+}
+
+// getStages reads back the stage DSL recorded on job, if any.
+func getStages(job *lighthousev1alpha1.LighthouseJob) ([]Stage, error) {
+	data, ok := job.Annotations[stagesAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var stages []Stage
+	if err := json.Unmarshal([]byte(data), &stages); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal stages")
+	}
+	return stages, nil
+}
+
+// setStages records the stage DSL stages on job.
+func setStages(job *lighthousev1alpha1.LighthouseJob, stages []Stage) error {
+	data, err := json.Marshal(stages)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal stages")
+	}
+	if job.Annotations == nil {
+		job.Annotations = map[string]string{}
+	}
+	job.Annotations[stagesAnnotation] = string(data)
+	return nil
+}
+
+// stageName returns the stage job annotates itself with, or rootStageName if job is the root of
+// its stage graph.
+func stageName(job *lighthousev1alpha1.LighthouseJob) string {
+	return job.Annotations[stageNameAnnotation]
+}
+
+// stageRootJobName returns the name of the root job of job's stage graph, falling back to job's
+// own name if it isn't annotated (i.e. job is the root itself).
+func stageRootJobName(job *lighthousev1alpha1.LighthouseJob) string {
+	if root := job.Annotations[stageRootJobNameAnnotation]; root != "" {
+		return root
+	}
+	return job.Name
+}
+
+// isTerminalStageState reports whether state is a finished outcome a dependent stage can react to.
+func isTerminalStageState(state lighthousev1alpha1.PipelineState) bool {
+	switch state {
+	case lighthousev1alpha1.SuccessState, lighthousev1alpha1.FailureState, lighthousev1alpha1.AbortedState:
+		return true
+	default:
+		return false
+	}
+}
+
+// reconcileStages fans a completed job out into any of its stage graph's children that are now
+// ready to run, or cancels them by creating them directly in AbortedState if job failed. It's a
+// no-op for jobs that don't carry a stage DSL.
+func (r *LighthouseJobReconciler) reconcileStages(ctx context.Context, namespace string, job *lighthousev1alpha1.LighthouseJob) error {
+	stages, err := getStages(job)
+	if err != nil {
+		return err
+	}
+	if len(stages) == 0 {
+		return nil
+	}
+
+	rootName := stageRootJobName(job)
+	var graph lighthousev1alpha1.LighthouseJobList
+	if err := r.client.List(ctx, &graph, client.InNamespace(namespace), client.MatchingFields{stageRootJobNameKey: rootName}); err != nil {
+		return errors.Wrap(err, "failed to list stage jobs")
+	}
+
+	stageState := map[string]lighthousev1alpha1.PipelineState{}
+	for i := range graph.Items {
+		sibling := &graph.Items[i]
+		stageState[stageName(sibling)] = sibling.Status.State
+	}
+	// job's own Status.Update can race the List above, so account for it separately.
+	stageState[stageName(job)] = job.Status.State
+
+	for _, stage := range stages {
+		if _, alreadyCreated := stageState[stage.Name]; alreadyCreated {
+			continue
+		}
+
+		deps := stage.DependsOn
+		if len(deps) == 0 {
+			deps = []string{rootStageName}
+		}
+
+		ready := true
+		cancel := false
+		for _, dep := range deps {
+			state, exists := stageState[dep]
+			if !exists || !isTerminalStageState(state) {
+				ready = false
+				break
+			}
+			if state != lighthousev1alpha1.SuccessState {
+				cancel = true
+			}
+		}
+		if !ready {
+			continue
+		}
+
+		child := buildStageJob(job, rootName, stage, cancel)
+		if err := r.client.Create(ctx, child); err != nil {
+			return errors.Wrapf(err, "failed to create stage job %s", stage.Name)
+		}
+		// Create persists child with a zeroed Status; push the intended state separately.
+		if err := r.client.Status().Update(ctx, child); err != nil {
+			return errors.Wrapf(err, "failed to update status of stage job %s", stage.Name)
+		}
+	}
+	return nil
+}
+
+// buildStageJob creates the LighthouseJob for stage, whose immediate predecessor in the graph is
+// parent. If cancel is true the job is created already in AbortedState.
+func buildStageJob(parent *lighthousev1alpha1.LighthouseJob, rootName string, stage Stage, cancel bool) *lighthousev1alpha1.LighthouseJob {
+	state := lighthousev1alpha1.TriggeredState
+	if cancel {
+		state = lighthousev1alpha1.AbortedState
+	}
+	child := &lighthousev1alpha1.LighthouseJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      rootName + "-" + stage.Name,
+			Namespace: parent.Namespace,
+			Annotations: map[string]string{
+				stagePredecessorAnnotation: parent.Name,
+				stageNameAnnotation:        stage.Name,
+				stageRootJobNameAnnotation: rootName,
+				stagesAnnotation:           parent.Annotations[stagesAnnotation],
+			},
+		},
+		Spec: parent.Spec,
+	}
+	child.Spec.Job = stage.Job
+	child.Spec.Context = stage.Name
+	child.Status = lighthousev1alpha1.LighthouseJobStatus{
+		State: state,
+	}
+	return child
+}
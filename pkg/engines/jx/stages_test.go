@@ -0,0 +1,195 @@
+package jx
+
+import (
+	"context"
+	"testing"
+
+	jxv1 "github.com/jenkins-x/jx-api/pkg/apis/jenkins.io/v1"
+	lighthousev1alpha1 "github.com/jenkins-x/lighthouse/pkg/apis/lighthouse/v1alpha1"
+	configjob "github.com/jenkins-x/lighthouse/pkg/config/job"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+const stagesTestNamespace = "jx"
+
+func newStagesTestReconciler(t *testing.T, initObjs ...runtime.Object) *LighthouseJobReconciler {
+	scheme := runtime.NewScheme()
+	err := lighthousev1alpha1.AddToScheme(scheme)
+	assert.NoError(t, err)
+	err = jxv1.AddToScheme(scheme)
+	assert.NoError(t, err)
+	c := fake.NewFakeClientWithScheme(scheme, initObjs...)
+	reconciler, err := NewLighthouseJobReconciler(c, scheme, stagesTestNamespace, &fakeMetapipelineClient{}, &fakeCustomTaskClient{}, &fakeBranchSHAResolver{})
+	assert.NoError(t, err)
+	return reconciler
+}
+
+func newRootJob(t *testing.T, name string, state lighthousev1alpha1.PipelineState, stages []Stage) *lighthousev1alpha1.LighthouseJob {
+	job := &lighthousev1alpha1.LighthouseJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: stagesTestNamespace,
+		},
+		Status: lighthousev1alpha1.LighthouseJobStatus{
+			State: state,
+		},
+	}
+	err := setStages(job, stages)
+	assert.NoError(t, err)
+	return job
+}
+
+func childrenOf(t *testing.T, reconciler *LighthouseJobReconciler, rootName string) []lighthousev1alpha1.LighthouseJob {
+	var list lighthousev1alpha1.LighthouseJobList
+	err := reconciler.client.List(context.Background(), &list, client.InNamespace(stagesTestNamespace))
+	assert.NoError(t, err)
+	var children []lighthousev1alpha1.LighthouseJob
+	for _, job := range list.Items {
+		if job.Name != rootName {
+			children = append(children, job)
+		}
+	}
+	return children
+}
+
+func TestReconcileStagesLinear(t *testing.T) {
+	stages := []Stage{
+		{Name: "build", Job: "build-job"},
+		{Name: "deploy", Job: "deploy-job", DependsOn: []string{"build"}},
+	}
+	root := newRootJob(t, "root", lighthousev1alpha1.SuccessState, stages)
+	reconciler := newStagesTestReconciler(t, root)
+
+	err := reconciler.reconcileStages(context.Background(), stagesTestNamespace, root)
+	assert.NoError(t, err)
+
+	children := childrenOf(t, reconciler, root.Name)
+	assert.Len(t, children, 1)
+	assert.Equal(t, "build", stageName(&children[0]))
+	assert.Equal(t, lighthousev1alpha1.TriggeredState, children[0].Status.State)
+
+	buildJob := children[0].DeepCopy()
+	buildJob.Status.State = lighthousev1alpha1.SuccessState
+	err = reconciler.reconcileStages(context.Background(), stagesTestNamespace, buildJob)
+	assert.NoError(t, err)
+
+	children = childrenOf(t, reconciler, root.Name)
+	assert.Len(t, children, 2)
+	names := map[string]lighthousev1alpha1.PipelineState{}
+	for _, child := range children {
+		names[stageName(&child)] = child.Status.State
+	}
+	assert.Equal(t, lighthousev1alpha1.TriggeredState, names["deploy"])
+}
+
+func TestReconcileStagesFanOut(t *testing.T) {
+	stages := []Stage{
+		{Name: "unit-tests", Job: "unit-job"},
+		{Name: "lint", Job: "lint-job"},
+	}
+	root := newRootJob(t, "root", lighthousev1alpha1.SuccessState, stages)
+	reconciler := newStagesTestReconciler(t, root)
+
+	err := reconciler.reconcileStages(context.Background(), stagesTestNamespace, root)
+	assert.NoError(t, err)
+
+	children := childrenOf(t, reconciler, root.Name)
+	assert.Len(t, children, 2)
+	for _, child := range children {
+		assert.Equal(t, lighthousev1alpha1.TriggeredState, child.Status.State)
+	}
+}
+
+// TestBuildStageJobIsNotARerun guards against stage jobs being misidentified as reruns: both
+// subsystems fan a new LighthouseJob out from an existing one, but only rerun.go's parentJobName
+// annotation should ever make isRerun return true.
+func TestBuildStageJobIsNotARerun(t *testing.T) {
+	parent := newRootJob(t, "root", lighthousev1alpha1.SuccessState, []Stage{
+		{Name: "build", Job: "build-job"},
+	})
+	child := buildStageJob(parent, "root", Stage{Name: "build", Job: "build-job"}, false)
+	assert.False(t, isRerun(child))
+	assert.Equal(t, "root", child.Annotations[stagePredecessorAnnotation])
+}
+
+func TestReconcileStagesFailureCancel(t *testing.T) {
+	stages := []Stage{
+		{Name: "deploy", Job: "deploy-job"},
+	}
+	root := newRootJob(t, "root", lighthousev1alpha1.FailureState, stages)
+	reconciler := newStagesTestReconciler(t, root)
+
+	err := reconciler.reconcileStages(context.Background(), stagesTestNamespace, root)
+	assert.NoError(t, err)
+
+	children := childrenOf(t, reconciler, root.Name)
+	assert.Len(t, children, 1)
+	assert.Equal(t, lighthousev1alpha1.AbortedState, children[0].Status.State)
+}
+
+// TestReconcileCascadesAbortThroughReconcile verifies that a stage job cancelled because its own
+// predecessor failed - created directly in AbortedState with no PipelineActivity of its own - is
+// itself fanned out into its dependents the next time the controller reconciles it, rather than
+// stopping the cancellation one level below the job that actually failed.
+func TestReconcileCascadesAbortThroughReconcile(t *testing.T) {
+	stages := []Stage{
+		{Name: "build", Job: "build-job"},
+		{Name: "deploy", Job: "deploy-job", DependsOn: []string{"build"}},
+		{Name: "notify", Job: "notify-job", DependsOn: []string{"deploy"}},
+	}
+	root := newRootJob(t, "root", lighthousev1alpha1.SuccessState, stages)
+	root.Spec.Agent = configjob.JenkinsXAgent
+	reconciler := newStagesTestReconciler(t, root)
+
+	err := reconciler.reconcileStages(context.Background(), stagesTestNamespace, root)
+	assert.NoError(t, err)
+
+	children := childrenOf(t, reconciler, root.Name)
+	assert.Len(t, children, 1)
+	build := children[0].DeepCopy()
+	assert.Equal(t, "build", stageName(build))
+
+	// build fails, which cancels "deploy" directly in AbortedState.
+	build.Status.State = lighthousev1alpha1.FailureState
+	err = reconciler.reconcileStages(context.Background(), stagesTestNamespace, build)
+	assert.NoError(t, err)
+
+	children = childrenOf(t, reconciler, root.Name)
+	assert.Len(t, children, 2)
+	var deploy *lighthousev1alpha1.LighthouseJob
+	for i := range children {
+		if stageName(&children[i]) == "deploy" {
+			deploy = &children[i]
+		}
+	}
+	if !assert.NotNil(t, deploy) {
+		return
+	}
+	assert.Equal(t, lighthousev1alpha1.AbortedState, deploy.Status.State)
+
+	// Reconciling "deploy" itself - as the controller would once it observes the create/update -
+	// should cascade the cancellation on to "notify" even though "deploy" never got a
+	// PipelineActivity of its own.
+	_, err = reconciler.Reconcile(ctrl.Request{
+		NamespacedName: types.NamespacedName{Namespace: stagesTestNamespace, Name: deploy.Name},
+	})
+	assert.NoError(t, err)
+
+	children = childrenOf(t, reconciler, root.Name)
+	assert.Len(t, children, 3)
+	var notify *lighthousev1alpha1.LighthouseJob
+	for i := range children {
+		if stageName(&children[i]) == "notify" {
+			notify = &children[i]
+		}
+	}
+	if assert.NotNil(t, notify) {
+		assert.Equal(t, lighthousev1alpha1.AbortedState, notify.Status.State)
+	}
+}